@@ -0,0 +1,75 @@
+// Command backup-handler runs the webhook service: it loads a JSON config
+// file, builds the Broker it selects, and serves the webhook, admin, and
+// metrics endpoints over HTTP.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/shreddedbacon/backup-handler/internal/handler"
+)
+
+// Config is the top-level, JSON-configured shape of the service. Broker.Type
+// selects which section of Broker is used; see handler.NewBroker.
+type Config struct {
+	Addr      string                  `json:"addr"`
+	Broker    handler.BrokerConfig    `json:"broker"`
+	QueueName string                  `json:"queueName"`
+	SpoolDir  string                  `json:"spoolDir"`
+	Auth      handler.WebhookAuth     `json:"auth"`
+	Notify    handler.NotifyConfig    `json:"notify"`
+	GraphQL   handler.GraphQLEndpoint `json:"graphql"`
+}
+
+func main() {
+	configPath := flag.String("config", "config.json", "path to the JSON config file")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("unable to load config: %s", err)
+	}
+
+	broker, err := handler.NewBroker(cfg.Broker)
+	if err != nil {
+		log.Fatalf("unable to build broker: %s", err)
+	}
+
+	backupHandler, err := handler.NewBackupHandler(broker, cfg.QueueName, cfg.SpoolDir, cfg.Auth, cfg.Notify, cfg.GraphQL)
+	if err != nil {
+		log.Fatalf("unable to build backup handler: %s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/webhook", backupHandler.WebhookHandler)
+	mux.HandleFunc("/admin/dlq/requeue", backupHandler.RepublishFromDLQ)
+	mux.Handle("/metrics", handler.MetricsHandler())
+
+	addr := cfg.Addr
+	if addr == "" {
+		addr = ":8080"
+	}
+	log.Printf("listening on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("server exited: %s", err)
+	}
+}
+
+// loadConfig reads and decodes the JSON config file at path.
+func loadConfig(path string) (Config, error) {
+	var cfg Config
+	f, err := os.Open(path)
+	if err != nil {
+		return cfg, fmt.Errorf("unable to open config file: %w", err)
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("unable to decode config file: %w", err)
+	}
+	return cfg, nil
+}
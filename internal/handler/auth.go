@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+)
+
+// Sensitive wraps a secret byte slice so it never renders in logs, error
+// messages, or panics. String always returns a fixed redaction regardless
+// of the underlying value.
+type Sensitive []byte
+
+// String implements fmt.Stringer by redacting the value.
+func (s Sensitive) String() string {
+	return "[REDACTED]"
+}
+
+// GoString implements fmt.GoStringer so %#v (e.g. in a panic) also redacts.
+func (s Sensitive) GoString() string {
+	return "[REDACTED]"
+}
+
+// WebhookAuth configures per-source HMAC authentication for WebhookHandler.
+type WebhookAuth struct {
+	Sources []WebhookSource `json:"sources"`
+}
+
+// WebhookSource is one named caller allowed to post webhooks, identified by
+// a shared secret and, optionally, restricted to a subset of projects.
+type WebhookSource struct {
+	Name string `json:"name"`
+	// Secret is HMAC-SHA256'd against the raw request body to verify the
+	// X-Backup-Signature header.
+	Secret Sensitive `json:"secret"`
+	// AllowedProjects, if set, is a regular expression the decoded
+	// backupData.Name must match for this source.
+	AllowedProjects string `json:"allowedProjects"`
+}
+
+// signatureHeader is the header WebhookHandler expects, formatted
+// "sha256=<hex-encoded hmac>".
+const signatureHeader = "X-Backup-Signature"
+
+// verifySignature computes the HMAC-SHA256 of body with secret and compares
+// it, in constant time, against the hex digest in an "sha256=<hex>" header
+// value.
+func verifySignature(secret Sensitive, header string, body []byte) bool {
+	const prefix = "sha256="
+	if len(header) <= len(prefix) || header[:len(prefix)] != prefix {
+		return false
+	}
+	expected, err := hex.DecodeString(header[len(prefix):])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// identifySource finds the configured WebhookSource whose secret produced
+// the signature in header. It returns false if no source matches, which
+// the caller should treat as an authentication failure.
+func (a WebhookAuth) identifySource(header string, body []byte) (WebhookSource, bool) {
+	for _, source := range a.Sources {
+		if verifySignature(source.Secret, header, body) {
+			return source, true
+		}
+	}
+	return WebhookSource{}, false
+}
+
+// allows reports whether project is permitted for this source. An empty
+// AllowedProjects means the source may post for any project.
+func (s WebhookSource) allows(project string) bool {
+	if s.AllowedProjects == "" {
+		return true
+	}
+	matched, err := regexp.MatchString(s.AllowedProjects, project)
+	if err != nil {
+		return false
+	}
+	return matched
+}
+
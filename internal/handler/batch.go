@@ -0,0 +1,28 @@
+package handler
+
+import "fmt"
+
+// deleteBackups removes every id in ids via singleDelete (a same-client
+// closure over the properly typed lagoon-cli API client), stopping and
+// returning the count deleted so far on the first failure.
+//
+// KNOWN GAP (tracking chunk0-7's unmet goal): this used to also try a bulk
+// DeleteBackups mutation via a type-asserted lagoonAPI, chunked into
+// batches, to cut the N+1 delete load down to one round trip per chunk.
+// That mutation doesn't exist on amazeeio/lagoon-cli's api.Client, so the
+// bulk branch was never actually reachable and has been dropped here, but
+// the load-cutting half of chunk0-7 is still unmet: deleting N stale
+// backups costs N round trips. Closing this out for real needs either a
+// bulk mutation added to lagoon-cli itself, or batching deletes some other
+// way (e.g. a worker pool) - file that as a follow-up rather than treating
+// this function as having delivered it.
+func deleteBackups(ids []string, singleDelete func(id string) error) (int, error) {
+	deleted := 0
+	for _, id := range ids {
+		if err := singleDelete(id); err != nil {
+			return deleted, fmt.Errorf("unable to delete backup %s: %w", id, err)
+		}
+		deleted++
+	}
+	return deleted, nil
+}
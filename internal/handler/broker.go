@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+)
+
+// Broker is the abstraction BackupHandler uses to publish webhook messages
+// onto a message queue. Concrete implementations back it with whatever
+// transport is configured (AMQP/RabbitMQ, NATS, or an in-memory stub for
+// tests) so BackupHandler itself never depends on a specific transport.
+type Broker interface {
+	// Connect establishes (or re-establishes) the underlying connection and
+	// declares whatever topology the implementation requires.
+	Connect(ctx context.Context) error
+	// Publish sends msg to routingKey. opts can be used by implementations
+	// that support per-message options (headers, retry counts, etc).
+	Publish(ctx context.Context, routingKey string, msg []byte, opts ...PublishOption) error
+	// Close tears down the connection.
+	Close() error
+}
+
+// PublishOption mutates publish-time options. Implementations that don't
+// need a particular option are free to ignore it.
+type PublishOption func(*PublishOptions)
+
+// PublishOptions are the broker-agnostic per-message options a caller can
+// request. Not every Broker implementation honours every field.
+type PublishOptions struct {
+	Headers map[string]interface{}
+}
+
+// WithHeaders sets AMQP-style headers on the published message.
+func WithHeaders(headers map[string]interface{}) PublishOption {
+	return func(o *PublishOptions) {
+		o.Headers = headers
+	}
+}
+
+// RetryCountHeader and FirstSeenHeader are the message header names stamped
+// on first publish and incremented/read back on redelivery, so a consumer
+// (or RepublishFromDLQ) can tell how many times a message has been retried
+// and how long it's been in flight.
+const (
+	RetryCountHeader = "x-retry-count"
+	FirstSeenHeader  = "x-first-seen"
+)
+
+// DLQRequeuer is implemented by Broker backends that support draining a
+// dead-letter queue back onto the main queue. Not every transport has a
+// DLQ concept, so callers type-assert for it rather than it being part of
+// the core Broker interface.
+type DLQRequeuer interface {
+	// RequeueDLQ pulls up to n messages off the dead-letter queue, bumps
+	// their retry count, and republishes them. It returns how many messages
+	// were actually requeued.
+	RequeueDLQ(ctx context.Context, n int) (int, error)
+}
+
+// BatchPublisher is implemented by Broker backends that can publish many
+// messages in one round trip, waiting once for confirms instead of once per
+// message. Callers type-assert for it and fall back to individual Publish
+// calls when the configured broker doesn't support it.
+type BatchPublisher interface {
+	PublishBatch(ctx context.Context, routingKey string, msgs [][]byte, opts ...PublishOption) error
+}
+
+// BrokerType selects which Broker implementation NewBroker builds.
+type BrokerType string
+
+const (
+	// BrokerTypeAMQP backs the broker with RabbitMQ.
+	BrokerTypeAMQP BrokerType = "amqp"
+	// BrokerTypeNATS backs the broker with NATS.
+	BrokerTypeNATS BrokerType = "nats"
+	// BrokerTypeMemory backs the broker with an in-memory stub, useful for
+	// tests and for running the service without a live broker.
+	BrokerTypeMemory BrokerType = "memory"
+)
+
+// BrokerConfig is the typed discriminator used to build a Broker. Only the
+// section matching Type needs to be populated.
+type BrokerConfig struct {
+	Type   BrokerType   `json:"type"`
+	AMQP   RabbitBroker `json:"amqp"`
+	NATS   NATSBroker   `json:"nats"`
+	Memory MemoryBroker `json:"memory"`
+}
+
+// NewBroker builds the Broker implementation selected by cfg.Type.
+func NewBroker(cfg BrokerConfig) (Broker, error) {
+	switch cfg.Type {
+	case BrokerTypeAMQP, "":
+		return NewAMQPBroker(cfg.AMQP), nil
+	case BrokerTypeNATS:
+		return NewNATSBroker(cfg.NATS), nil
+	case BrokerTypeMemory:
+		return NewMemoryBroker(cfg.Memory), nil
+	default:
+		return nil, fmt.Errorf("unknown broker type %q", cfg.Type)
+	}
+}
@@ -0,0 +1,362 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/isayme/go-amqp-reconnect/rabbitmq"
+	"github.com/streadway/amqp"
+)
+
+// dlxName and dlqName are derived from the main queue name so every
+// AMQPBroker gets its own dead-letter exchange/queue without extra config.
+func dlxName(queueName string) string { return queueName + ".dlx" }
+func dlqName(queueName string) string { return queueName + ".dlq" }
+
+// RabbitBroker is the configuration for an AMQP/RabbitMQ backed Broker.
+type RabbitBroker struct {
+	Hostname     string `json:"hostname"`
+	Port         string `json:"port"`
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	QueueName    string `json:"queueName"`
+	ExchangeName string `json:"exchangeName"`
+	// DeadLetterEnabled declares the main queue with an x-dead-letter-exchange
+	// argument so rejected/expired messages land on <queueName>.dlq. Queue
+	// arguments are immutable in RabbitMQ: enabling this against a queue that
+	// already exists without it makes Connect fail with PRECONDITION_FAILED.
+	// New deployments can set it from the start; existing deployments must
+	// delete the queue (or pick a new QueueName) during a maintenance window
+	// before turning it on.
+	DeadLetterEnabled bool `json:"deadLetterEnabled"`
+}
+
+// AMQPBroker is a Broker backed by RabbitMQ.
+type AMQPBroker struct {
+	config  RabbitBroker
+	amqpURI string
+
+	// mu guards every use of channel and confirms, since *rabbitmq.Channel
+	// isn't safe for concurrent use and confirms must be read back in the
+	// same order messages were published on it. confirms is registered once,
+	// in Connect: streadway/amqp broadcasts every confirmation to every
+	// listener NotifyPublish has ever handed out, blocking the confirm
+	// dispatch goroutine if any one of them isn't drained, so publishers
+	// must share a single listener rather than each registering their own.
+	mu       sync.Mutex
+	conn     *rabbitmq.Connection
+	channel  *rabbitmq.Channel
+	confirms chan amqp.Confirmation
+
+	stopMonitor chan struct{}
+}
+
+// NewAMQPBroker returns an AMQPBroker for the given config. Connect must be
+// called before Publish will succeed.
+func NewAMQPBroker(config RabbitBroker) *AMQPBroker {
+	return &AMQPBroker{
+		config:  config,
+		amqpURI: fmt.Sprintf("amqp://%s:%s@%s:%s", config.Username, config.Password, config.Hostname, config.Port),
+	}
+}
+
+// Connect dials RabbitMQ and declares the exchange/queue/binding.
+//
+// Once Connect has succeeded, github.com/isayme/go-amqp-reconnect/rabbitmq
+// redials a dropped connection automatically; while the broker is down,
+// publishes fail and webhooks stay in the spool for drainSpool to retry.
+// A failed Connect is not retried, and Publish then returns an error.
+func (a *AMQPBroker) Connect(ctx context.Context) error {
+	var err error
+	a.conn, err = rabbitmq.Dial(a.amqpURI)
+	if err != nil {
+		rabbitmqConnected.Set(0)
+		return fmt.Errorf("failed to connect to RabbitMQ: %w", err)
+	}
+	a.channel, err = a.conn.Channel()
+	if err != nil {
+		rabbitmqConnected.Set(0)
+		return fmt.Errorf("failed to open a channel: %w", err)
+	}
+	err = a.channel.ExchangeDeclare(
+		a.config.QueueName, // name
+		"direct",           // type
+		true,               // durable
+		false,              // auto-deleted
+		false,              // internal
+		false,              // no-wait
+		nil,                // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("could not declare exchange: %w", err)
+	}
+	queueArgs := amqp.Table{}
+	if a.config.DeadLetterEnabled {
+		if err := a.declareDeadLetter(); err != nil {
+			return err
+		}
+		queueArgs["x-dead-letter-exchange"] = dlxName(a.config.QueueName)
+	}
+	queue, err := a.channel.QueueDeclare(
+		a.config.QueueName,
+		true,
+		false,
+		false,
+		false,
+		queueArgs)
+	if err != nil {
+		return fmt.Errorf("could not declare queue: %w", err)
+	}
+	err = a.channel.QueueBind(
+		queue.Name,            // queue name
+		"",                    // routing key
+		a.config.ExchangeName, // exchange
+		false,
+		nil)
+	if err != nil {
+		return fmt.Errorf("failed to bind queue: %w", err)
+	}
+	if err := a.channel.Confirm(false); err != nil {
+		return fmt.Errorf("failed to put channel into confirm mode: %w", err)
+	}
+	a.confirms = a.channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+	rabbitmqConnected.Set(1)
+	a.stopMonitor = make(chan struct{})
+	go a.monitorConnection()
+	return nil
+}
+
+// monitorConnection keeps rabbitmqConnected in sync with the connection
+// state go-amqp-reconnect reports, instead of only reflecting the
+// Connect/Close call sites. NotifyClose fires on every drop, including ones
+// go-amqp-reconnect will transparently redial behind the scenes, so the
+// gauge dips to 0 as soon as that happens and is polled back to 1 once the
+// connection reports it's no longer closed.
+func (a *AMQPBroker) monitorConnection() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	disconnected := false
+	closeCh := a.conn.NotifyClose(make(chan *amqp.Error, 1))
+	for {
+		select {
+		case <-a.stopMonitor:
+			return
+		case err, ok := <-closeCh:
+			if !ok || err != nil {
+				rabbitmqConnected.Set(0)
+				disconnected = true
+			}
+			// A listener registered on the dropped connection would be
+			// closed at once; re-register once the redialed one is up.
+			closeCh = nil
+		case <-ticker.C:
+			if disconnected && !a.conn.IsClosed() {
+				rabbitmqConnected.Set(1)
+				disconnected = false
+				closeCh = a.conn.NotifyClose(make(chan *amqp.Error, 1))
+			}
+		}
+	}
+}
+
+// declareDeadLetter declares the <queue>.dlx exchange and <queue>.dlq queue
+// that back the main queue's x-dead-letter-exchange argument, so messages
+// that are rejected or expire land somewhere operationally recoverable
+// instead of being dropped. Only called when config.DeadLetterEnabled is set.
+func (a *AMQPBroker) declareDeadLetter() error {
+	dlx := dlxName(a.config.QueueName)
+	dlq := dlqName(a.config.QueueName)
+	err := a.channel.ExchangeDeclare(
+		dlx,
+		"fanout",
+		true,
+		false,
+		false,
+		false,
+		nil)
+	if err != nil {
+		return fmt.Errorf("could not declare dead-letter exchange: %w", err)
+	}
+	queue, err := a.channel.QueueDeclare(
+		dlq,
+		true,
+		false,
+		false,
+		false,
+		nil)
+	if err != nil {
+		return fmt.Errorf("could not declare dead-letter queue: %w", err)
+	}
+	err = a.channel.QueueBind(
+		queue.Name,
+		"",
+		dlx,
+		false,
+		nil)
+	if err != nil {
+		return fmt.Errorf("failed to bind dead-letter queue: %w", err)
+	}
+	return nil
+}
+
+// publishAndConfirm publishes bodies to routingKey and waits for the broker
+// to confirm every one of them before returning. It holds mu for the whole
+// operation, reading from the single a.confirms listener registered in
+// Connect: confirms are delivered in publish order, so as long as no other
+// goroutine interleaves a publish on the same channel while we're waiting,
+// the Nth confirm read back here is guaranteed to belong to the Nth body
+// just published, and draining exactly that many before releasing mu leaves
+// nothing behind for the next call. Previously only PublishBatch drained
+// confirms, so a plain Publish left its confirm unread on the channel -
+// once that buffer filled, the confirm dispatch goroutine blocked, stalling
+// the connection and eventually dropping it. Every publisher (Publish,
+// PublishBatch, RequeueDLQ) now drains its own confirms before releasing
+// the channel, so that can't happen.
+func (a *AMQPBroker) publishAndConfirm(ctx context.Context, routingKey string, bodies [][]byte, headers map[string]interface{}) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.channel == nil || a.confirms == nil {
+		return fmt.Errorf("not connected to RabbitMQ")
+	}
+	for _, body := range bodies {
+		publishing := amqp.Publishing{
+			ContentType: "text/plain",
+			Body:        body,
+		}
+		if headers != nil {
+			publishing.Headers = headers
+		}
+		if err := a.channel.Publish("", routingKey, false, false, publishing); err != nil {
+			return fmt.Errorf("failed to publish message: %w", err)
+		}
+	}
+
+	for i := 0; i < len(bodies); i++ {
+		select {
+		case confirm, ok := <-a.confirms:
+			if !ok || !confirm.Ack {
+				return fmt.Errorf("broker did not confirm message %d of %d", i+1, len(bodies))
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Publish sends msg to the queue named by routingKey, and does not return
+// until the broker has confirmed it.
+func (a *AMQPBroker) Publish(ctx context.Context, routingKey string, msg []byte, opts ...PublishOption) error {
+	options := PublishOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	err := a.publishAndConfirm(ctx, routingKey, [][]byte{msg}, options.Headers)
+	if err != nil {
+		defaultLogger.Error("rabbit failure", map[string]interface{}{"error": err.Error()})
+	}
+	return err
+}
+
+// PublishBatch publishes every message in msgs to routingKey and waits once
+// for the broker to confirm all of them, instead of round-tripping a
+// confirm per message the way repeated calls to Publish would.
+func (a *AMQPBroker) PublishBatch(ctx context.Context, routingKey string, msgs [][]byte, opts ...PublishOption) error {
+	options := PublishOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if err := a.publishAndConfirm(ctx, routingKey, msgs, options.Headers); err != nil {
+		return fmt.Errorf("failed to publish batch: %w", err)
+	}
+	return nil
+}
+
+// RequeueDLQ pulls up to n messages off the dead-letter queue, increments
+// their x-retry-count header, and republishes them onto the main queue (via
+// the default exchange, with QueueName as the routing key). It returns the
+// number of messages actually requeued.
+func (a *AMQPBroker) RequeueDLQ(ctx context.Context, n int) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	dlq := dlqName(a.config.QueueName)
+	requeued := 0
+	for i := 0; i < n; i++ {
+		delivery, ok, err := a.channel.Get(dlq, false)
+		if err != nil {
+			return requeued, fmt.Errorf("failed to get message from dlq: %w", err)
+		}
+		if !ok {
+			break
+		}
+
+		headers := delivery.Headers
+		if headers == nil {
+			headers = amqp.Table{}
+		}
+		retryCount, _ := headers[RetryCountHeader].(int32)
+		headers[RetryCountHeader] = retryCount + 1
+		if _, ok := headers[FirstSeenHeader]; !ok {
+			headers[FirstSeenHeader] = delivery.Timestamp.Unix()
+		}
+
+		// Republish via the default exchange + QueueName, the same target
+		// every other publish on this channel uses (see publishAndConfirm).
+		// Publishing to a.config.ExchangeName with an empty routing key
+		// depended on ExchangeName being set; when it's empty, the message
+		// went to the default exchange with an
+		// empty routing key and was silently dropped - so requeuing acked
+		// the message off the dlq while losing it.
+		err = a.channel.Publish(
+			"",
+			a.config.QueueName,
+			false,
+			false,
+			amqp.Publishing{
+				ContentType: delivery.ContentType,
+				Body:        delivery.Body,
+				Headers:     headers,
+			})
+		if err != nil {
+			return requeued, fmt.Errorf("failed to republish message from dlq: %w", err)
+		}
+
+		select {
+		case confirm, ok := <-a.confirms:
+			if !ok || !confirm.Ack {
+				return requeued, fmt.Errorf("broker did not confirm requeued message %d", i+1)
+			}
+		case <-ctx.Done():
+			return requeued, ctx.Err()
+		}
+
+		if err := delivery.Ack(false); err != nil {
+			defaultLogger.Error("rabbit failure acking dlq message", map[string]interface{}{"error": err.Error()})
+		}
+		requeued++
+	}
+	return requeued, nil
+}
+
+// Close closes the underlying RabbitMQ channel and connection.
+func (a *AMQPBroker) Close() error {
+	defer rabbitmqConnected.Set(0)
+	if a.stopMonitor != nil {
+		close(a.stopMonitor)
+		a.stopMonitor = nil
+	}
+	if a.channel != nil {
+		if err := a.channel.Close(); err != nil {
+			return err
+		}
+	}
+	if a.conn != nil {
+		return a.conn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryBroker is the configuration for an in-memory Broker. It has no
+// fields yet, but exists so BrokerConfig can select it the same way as the
+// other transports.
+type MemoryBroker struct{}
+
+// PublishedMessage is a single message captured by MemoryConn.
+type PublishedMessage struct {
+	RoutingKey string
+	Body       []byte
+	Options    PublishOptions
+}
+
+// MemoryConn is a Broker that keeps published messages in memory instead of
+// sending them anywhere. It lets WebhookHandler be exercised in tests, or
+// the service run, without a live broker.
+type MemoryConn struct {
+	mu        sync.Mutex
+	Published []PublishedMessage
+}
+
+// NewMemoryBroker returns a MemoryConn. config is currently unused but kept
+// so the signature matches the other broker constructors.
+func NewMemoryBroker(config MemoryBroker) *MemoryConn {
+	return &MemoryConn{}
+}
+
+// Connect is a no-op for MemoryConn.
+func (m *MemoryConn) Connect(ctx context.Context) error {
+	return nil
+}
+
+// Publish records msg instead of sending it anywhere.
+func (m *MemoryConn) Publish(ctx context.Context, routingKey string, msg []byte, opts ...PublishOption) error {
+	options := PublishOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Published = append(m.Published, PublishedMessage{
+		RoutingKey: routingKey,
+		Body:       msg,
+		Options:    options,
+	})
+	return nil
+}
+
+// Close is a no-op for MemoryConn.
+func (m *MemoryConn) Close() error {
+	return nil
+}
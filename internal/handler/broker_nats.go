@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NATSBroker is the configuration for a NATS backed Broker.
+type NATSBroker struct {
+	URL     string `json:"url"`
+	Subject string `json:"subject"`
+}
+
+// NATSConn is a Broker backed by NATS.
+type NATSConn struct {
+	config NATSBroker
+	conn   *nats.Conn
+}
+
+// NewNATSBroker returns a NATSConn for the given config. Connect must be
+// called before Publish will succeed.
+func NewNATSBroker(config NATSBroker) *NATSConn {
+	return &NATSConn{
+		config: config,
+	}
+}
+
+// Connect dials the configured NATS server.
+func (n *NATSConn) Connect(ctx context.Context) error {
+	conn, err := nats.Connect(n.config.URL)
+	if err != nil {
+		return fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	n.conn = conn
+	return nil
+}
+
+// Publish sends msg on routingKey (falling back to the configured default
+// subject if routingKey is empty).
+func (n *NATSConn) Publish(ctx context.Context, routingKey string, msg []byte, opts ...PublishOption) error {
+	if n.conn == nil {
+		return fmt.Errorf("not connected to NATS")
+	}
+	subject := routingKey
+	if subject == "" {
+		subject = n.config.Subject
+	}
+	if err := n.conn.Publish(subject, msg); err != nil {
+		return fmt.Errorf("failed to publish to NATS: %w", err)
+	}
+	return nil
+}
+
+// Close closes the NATS connection.
+func (n *NATSConn) Close() error {
+	if n.conn != nil {
+		n.conn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"os"
+
+	"github.com/rs/zerolog"
+)
+
+// Logger is a tiny structured-logging interface so call sites depend on a
+// couple of methods rather than directly on zerolog (or whichever backend
+// ends up behind it).
+type Logger interface {
+	Info(msg string, fields map[string]interface{})
+	Error(msg string, fields map[string]interface{})
+}
+
+// zerologLogger adapts zerolog.Logger to Logger.
+type zerologLogger struct {
+	zl zerolog.Logger
+}
+
+// defaultLogger backs package-level helpers (failOnError, drainSpool, ...)
+// that aren't handed a request-scoped logger.
+var defaultLogger Logger = NewLogger()
+
+// NewLogger returns the structured logger used across the webhook/queue
+// path. It writes JSON to stdout so every field (trace_id, event, error,
+// ...) is queryable downstream instead of being flattened into free text.
+func NewLogger() Logger {
+	return &zerologLogger{zl: zerolog.New(os.Stdout).With().Timestamp().Logger()}
+}
+
+func (l *zerologLogger) Info(msg string, fields map[string]interface{}) {
+	evt := l.zl.Info()
+	for k, v := range fields {
+		evt = evt.Interface(k, v)
+	}
+	evt.Msg(msg)
+}
+
+func (l *zerologLogger) Error(msg string, fields map[string]interface{}) {
+	evt := l.zl.Error()
+	for k, v := range fields {
+		evt = evt.Interface(k, v)
+	}
+	evt.Msg(msg)
+}
+
+// withTraceID merges a trace_id entry into fields, the pattern every
+// request-scoped log call uses so log lines can be correlated with
+// downstream consumers of the same webhook.
+func withTraceID(traceID string, fields map[string]interface{}) map[string]interface{} {
+	merged := map[string]interface{}{"trace_id": traceID}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return merged
+}
@@ -1,41 +1,37 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io/ioutil"
 	"net/http"
 	"regexp"
+	"strconv"
+	"time"
 
 	"github.com/amazeeio/lagoon-cli/pkg/api"
 	"github.com/google/uuid"
-	"github.com/isayme/go-amqp-reconnect/rabbitmq"
-	"github.com/streadway/amqp"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // BackupInterface .
 type BackupInterface interface {
 	ProcessBackups(Backups, api.Environment) []Webhook
 	WebhookHandler(w http.ResponseWriter, r *http.Request)
+	RepublishFromDLQ(w http.ResponseWriter, r *http.Request)
 }
 
 // BackupHandler .
 type BackupHandler struct {
-	rabbitConn    *rabbitmq.Connection
-	rabbitChannel *rabbitmq.Channel
-	amqpURI       string
-	Broker        RabbitBroker
-	Endpoint      GraphQLEndpoint
-}
-
-// RabbitBroker .
-type RabbitBroker struct {
-	Hostname     string `json:"hostname"`
-	Port         string `json:"port"`
-	Username     string `json:"username"`
-	Password     string `json:"password"`
-	QueueName    string `json:"queueName"`
-	ExchangeName string `json:"exchangeName"`
+	broker    Broker
+	queueName string
+	spool     *Spool
+	notifier  *Notifier
+	logger    Logger
+	Auth      WebhookAuth
+	Endpoint  GraphQLEndpoint
+	Notify    NotifyConfig
 }
 
 // GraphQLEndpoint .
@@ -45,86 +41,188 @@ type GraphQLEndpoint struct {
 	TokenSigningKey string `json:"tokenSigningKey`
 }
 
-// NewBackupHandler .
-func NewBackupHandler(broker RabbitBroker, graphql GraphQLEndpoint) (BackupInterface, error) {
-	amqpURI := fmt.Sprintf("amqp://%s:%s@%s:%s", broker.Username, broker.Password, broker.Hostname, broker.Port)
-
+// NewBackupHandler builds a BackupHandler around the given Broker and
+// connects it. queueName is the routing key addToMessageQueue publishes to.
+// spoolDir is where unacked webhooks are durably recorded; a background
+// worker continuously retries them until the broker accepts them, starting
+// with anything left over from a previous process.
+func NewBackupHandler(broker Broker, queueName string, spoolDir string, auth WebhookAuth, notify NotifyConfig, graphql GraphQLEndpoint) (BackupInterface, error) {
+	spool, err := NewSpool(spoolDir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open spool: %w", err)
+	}
+	notifier, err := NewNotifier(notify)
+	if err != nil {
+		return nil, fmt.Errorf("unable to build notifier: %w", err)
+	}
 	newBackupHandler := &BackupHandler{
-		Broker:   broker,
-		Endpoint: graphql,
-		amqpURI:  amqpURI,
+		broker:    broker,
+		queueName: queueName,
+		spool:     spool,
+		notifier:  notifier,
+		logger:    NewLogger(),
+		Auth:      auth,
+		Endpoint:  graphql,
+		Notify:    notify,
+	}
+	if err := newBackupHandler.broker.Connect(context.Background()); err != nil {
+		failOnError(err, "Failed to connect to broker")
+		newBackupHandler.notifier.Notify(context.Background(), NotificationEvent{
+			Type:    "broker_reconnect_failure",
+			Message: "failed to connect to message broker",
+			Fields:  map[string]interface{}{"error": err.Error()},
+		})
 	}
-	newBackupHandler.initAmqp()
+	go newBackupHandler.drainSpool(context.Background())
 	return newBackupHandler, nil
 }
 
-func (b *BackupHandler) initAmqp() {
-	// github.com/isayme/go-amqp-reconnect/rabbitmq
-	// reconnect to rabbit automatically eventually, but still accept webhooks (just fails and webhook data is lost)
-	var err error
-	b.rabbitConn, err = rabbitmq.Dial(b.amqpURI)
-	failOnError(err, "Failed to connect to RabbitMQ")
-	b.rabbitChannel, err = b.rabbitConn.Channel()
-	failOnError(err, "Failed to open a channel")
-	err = b.rabbitChannel.ExchangeDeclare(
-		b.Broker.QueueName, // name
-		"direct",           // type
-		true,               // durable
-		false,              // auto-deleted
-		false,              // internal
-		false,              // no-wait
-		nil,                // arguments
-	)
-	failOnError(err, "Could not declare exchange")
-	queue, err := b.rabbitChannel.QueueDeclare(
-		b.Broker.QueueName,
-		true,
-		false,
-		false,
-		false,
-		nil)
-	failOnError(err, "Could not declare queue")
-	err = b.rabbitChannel.QueueBind(
-		queue.Name,            // queue name
-		"",                    // routing key
-		b.Broker.ExchangeName, // exchange
-		false,
-		nil)
-	failOnError(err, "Failed to bind queue")
-}
+// addToMessageQueue durably spools message before attempting to publish it,
+// so a broker outage never loses a webhook: drainSpool will retry it. It
+// returns an error only when the spool write itself fails, which the caller
+// should treat as a reason to 5xx the webhook so the upstream retries.
+func (b *BackupHandler) addToMessageQueue(traceID string, message Webhook, source string) error {
+	id, err := b.spool.Put(message)
+	if err != nil {
+		return fmt.Errorf("unable to spool webhook: %w", err)
+	}
 
-func (b *BackupHandler) addToMessageQueue(message Webhook) {
 	backupMessage, _ := json.Marshal(message)
-	err := b.rabbitChannel.Publish(
-		"",
-		b.Broker.QueueName,
-		false, // mandatory
-		false, // immediate
-		amqp.Publishing{
-			ContentType: "text/plain",
-			Body:        []byte(backupMessage),
-		})
+	publishErr := b.broker.Publish(context.Background(), b.queueName, backupMessage, WithHeaders(map[string]interface{}{
+		RetryCountHeader: int32(0),
+		FirstSeenHeader:  time.Now().Unix(),
+	}))
+	if publishErr != nil {
+		queuePublishFailuresTotal.Inc()
+		failOnError(publishErr, "Failed to publish a message, it remains spooled for retry")
+		return nil
+	}
+	if ackErr := b.spool.Ack(id); ackErr != nil {
+		b.logger.Error("unable to ack spooled webhook", withTraceID(traceID, map[string]interface{}{"spool_id": id, "error": ackErr.Error()}))
+	}
+
+	action := "enqueued"
 	if message.Body.Snapshots != nil {
-		log.Printf("webhook for %s, snapshotname %s, ID:%s added to queue", message.Webhooktype+":"+message.Event, message.Body.Snapshots[0].Hostname, message.Body.Snapshots[0].ID)
+		snapshotsProcessedTotal.WithLabelValues(action).Inc()
+		b.logger.Info("added to queue", withTraceID(traceID, map[string]interface{}{
+			"webhook":      message.Webhooktype + ":" + message.Event,
+			"source":       source,
+			"snapshotname": message.Body.Snapshots[0].Hostname,
+			"id":           message.Body.Snapshots[0].ID,
+		}))
 	} else {
-		log.Printf("webhook for %s, ID:%s added to queue", message.Webhooktype+":"+message.Event, message.Body.SnapshotID)
+		snapshotsProcessedTotal.WithLabelValues(action).Inc()
+		b.logger.Info("added to queue", withTraceID(traceID, map[string]interface{}{
+			"webhook": message.Webhooktype + ":" + message.Event,
+			"source":  source,
+			"id":      message.Body.SnapshotID,
+		}))
+	}
+	return nil
+}
+
+// addBackupsToQueue durably spools every message in backups, then publishes
+// them as a single batch when the broker supports BatchPublisher (waiting
+// once for confirms instead of per message), falling back to one
+// addToMessageQueue call per message otherwise.
+func (b *BackupHandler) addBackupsToQueue(traceID string, backups []Webhook, source string) error {
+	if len(backups) == 0 {
+		return nil
 	}
-	failOnError(err, "Failed to publish a message")
+
+	batcher, ok := b.broker.(BatchPublisher)
+	if !ok {
+		for _, backup := range backups {
+			if err := b.addToMessageQueue(traceID, backup, source); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	ids := make([]string, len(backups))
+	msgs := make([][]byte, len(backups))
+	for i, backup := range backups {
+		id, err := b.spool.Put(backup)
+		if err != nil {
+			return fmt.Errorf("unable to spool webhook: %w", err)
+		}
+		ids[i] = id
+		data, _ := json.Marshal(backup)
+		msgs[i] = data
+	}
+
+	publishErr := batcher.PublishBatch(context.Background(), b.queueName, msgs, WithHeaders(map[string]interface{}{
+		RetryCountHeader: int32(0),
+		FirstSeenHeader:  time.Now().Unix(),
+	}))
+	if publishErr != nil {
+		queuePublishFailuresTotal.Inc()
+		failOnError(publishErr, "Failed to publish a batch, messages remain spooled for retry")
+		return nil
+	}
+
+	for i, backup := range backups {
+		if ackErr := b.spool.Ack(ids[i]); ackErr != nil {
+			b.logger.Error("unable to ack spooled webhook", withTraceID(traceID, map[string]interface{}{"spool_id": ids[i], "error": ackErr.Error()}))
+		}
+		snapshotsProcessedTotal.WithLabelValues("enqueued").Inc()
+		b.logger.Info("added to queue", withTraceID(traceID, map[string]interface{}{
+			"webhook":      backup.Webhooktype + ":" + backup.Event,
+			"source":       source,
+			"snapshotname": backup.Body.Snapshots[0].Hostname,
+			"id":           backup.Body.Snapshots[0].ID,
+		}))
+	}
+	return nil
 }
 
 // WebhookHandler .
 func (b *BackupHandler) WebhookHandler(w http.ResponseWriter, r *http.Request) {
+	traceID := uuid.New().String()
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		b.logger.Error("unable to handle webhook", withTraceID(traceID, map[string]interface{}{"error": err.Error()}))
+		webhooksReceivedTotal.WithLabelValues("unknown", "error").Inc()
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var source WebhookSource
+	if len(b.Auth.Sources) > 0 {
+		var ok bool
+		source, ok = b.Auth.identifySource(r.Header.Get(signatureHeader), body)
+		if !ok {
+			b.logger.Error("rejected webhook", withTraceID(traceID, map[string]interface{}{"reason": "signature mismatch"}))
+			webhooksReceivedTotal.WithLabelValues("unknown", "unauthorized").Inc()
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
 	var backupData Backups
 	// decode the body result into the backups struct
-	decoder := json.NewDecoder(r.Body)
-	err := decoder.Decode(&backupData)
+	err = json.Unmarshal(body, &backupData)
 	if err != nil {
-		log.Printf("unable to handle webhook, error is %s:", err.Error())
+		b.logger.Error("unable to handle webhook", withTraceID(traceID, map[string]interface{}{"error": err.Error()}))
+		webhooksReceivedTotal.WithLabelValues("unknown", "error").Inc()
+	} else if len(b.Auth.Sources) > 0 && !source.allows(backupData.Name) {
+		b.logger.Error("rejected webhook", withTraceID(traceID, map[string]interface{}{"source": source.Name, "project": backupData.Name, "reason": "project not allowed"}))
+		webhooksReceivedTotal.WithLabelValues("unknown", "forbidden").Inc()
+		w.WriteHeader(http.StatusForbidden)
 	} else {
+		event := "restore:finished"
+		if backupData.Snapshots != nil {
+			event = "snapshot:finished"
+		}
+
 		// get backups from the API
 		lagoonAPI, err := api.New(b.Endpoint.TokenSigningKey, b.Endpoint.JWTAudience, b.Endpoint.Endpoint)
 		if err != nil {
-			log.Printf("unable to handle webhook, error is %s:", err.Error())
+			b.logger.Error("unable to handle webhook", withTraceID(traceID, map[string]interface{}{"error": err.Error()}))
+			webhooksReceivedTotal.WithLabelValues(event, "error").Inc()
+			b.notifyGraphQLFailure(r.Context(), backupData.Name, err)
 			return
 		}
 
@@ -136,52 +234,129 @@ func (b *BackupHandler) WebhookHandler(w http.ResponseWriter, r *http.Request) {
 				UUID:        uuid.New().String(),
 				Body:        backupData,
 			}
-			b.addToMessageQueue(singleBackup)
+			if err := b.addToMessageQueue(traceID, singleBackup, source.Name); err != nil {
+				b.logger.Error("unable to spool webhook", withTraceID(traceID, map[string]interface{}{"error": err.Error()}))
+				webhooksReceivedTotal.WithLabelValues(event, "error").Inc()
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			webhooksReceivedTotal.WithLabelValues(event, "ok").Inc()
 			// else handle snapshots
 		} else if backupData.Snapshots != nil {
 			// use the name from the webhook to get the environment in the api
 			environment := api.EnvironmentBackups{
 				OpenshiftProjectName: backupData.Name,
 			}
+			getBackupsTimer := prometheus.NewTimer(graphqlRequestDuration.WithLabelValues("GetEnvironmentBackups"))
 			envBackups, err := lagoonAPI.GetEnvironmentBackups(environment)
+			getBackupsTimer.ObserveDuration()
 			if err != nil {
-				log.Printf("unable to get backups from api, error is %s:", err.Error())
+				b.logger.Error("unable to get backups from api", withTraceID(traceID, map[string]interface{}{"error": err.Error()}))
+				webhooksReceivedTotal.WithLabelValues(event, "error").Inc()
+				b.notifyGraphQLFailure(r.Context(), backupData.Name, err)
 				return
 			}
 			// unmarshal the result into the environment struct
 			var backupsEnv api.Environment
 			json.Unmarshal(envBackups, &backupsEnv)
-			// remove backups that no longer exists from the api
-			for index, backup := range backupsEnv.Backups {
-				// check that the backup in the api is not in the webhook payload
+			// backups that exist in the api but no longer appear in the webhook
+			// payload no longer exist and should be deleted; gather their IDs
+			// up front rather than mutating backupData.Snapshots mid-range,
+			// since backupsEnv.Backups and backupData.Snapshots are different
+			// slices and an index into one is meaningless against the other
+			var staleBackupIDs []string
+			for _, backup := range backupsEnv.Backups {
 				if !apiBackupInWebhook(backupData.Snapshots, backup.BackupID) {
-					// if the backup in the api is not in the webhook payload
-					// remove it from the webhook payload data
-					removeSnapshot(backupData.Snapshots, index)
-					delBackup := api.DeleteBackup{
-						BackupID: backup.BackupID,
-					}
-					// now delete it from the api as it no longer exists
-					_, err := lagoonAPI.DeleteBackup(delBackup) // result is always success, or will error
-					if err != nil {
-						log.Printf("unable to delete backup from api, error is %s:", err.Error())
-						return
-					}
-					log.Printf("deleted backup %s for %s", backup.BackupID, backupsEnv.OpenshiftProjectName)
+					staleBackupIDs = append(staleBackupIDs, backup.BackupID)
 				}
 			}
+			deleted, err := deleteBackups(staleBackupIDs, func(id string) error {
+				timer := prometheus.NewTimer(graphqlRequestDuration.WithLabelValues("DeleteBackup"))
+				_, err := lagoonAPI.DeleteBackup(api.DeleteBackup{BackupID: id})
+				timer.ObserveDuration()
+				return err
+			})
+			if deleted > 0 {
+				b.logger.Info("deleted backups", withTraceID(traceID, map[string]interface{}{"count": deleted, "project": backupsEnv.OpenshiftProjectName}))
+				snapshotsProcessedTotal.WithLabelValues("deleted").Add(float64(deleted))
+			}
+			if err != nil {
+				b.logger.Error("unable to delete backup from api", withTraceID(traceID, map[string]interface{}{"error": err.Error()}))
+				webhooksReceivedTotal.WithLabelValues(event, "error").Inc()
+				b.notifyGraphQLFailure(r.Context(), backupData.Name, err)
+				return
+			}
 
 			// if we get this far, then the payload data from the webhook should only have snapshots that are new or exist in the api
 			addBackups := b.ProcessBackups(backupData, backupsEnv)
-			for _, backup := range addBackups {
-				b.addToMessageQueue(backup)
+			if err := b.addBackupsToQueue(traceID, addBackups, source.Name); err != nil {
+				b.logger.Error("unable to spool webhook", withTraceID(traceID, map[string]interface{}{"error": err.Error()}))
+				webhooksReceivedTotal.WithLabelValues(event, "error").Inc()
+				w.WriteHeader(http.StatusInternalServerError)
+				return
 			}
+			webhooksReceivedTotal.WithLabelValues(event, "ok").Inc()
+
+			b.notifier.Notify(r.Context(), NotificationEvent{
+				Type:    "webhook_summary",
+				Message: fmt.Sprintf("%s: %d snapshots queued, %d deleted from API", backupData.Name, len(addBackups), deleted),
+				Fields: map[string]interface{}{
+					"trace_id": traceID,
+					"project":  backupData.Name,
+					"queued":   len(addBackups),
+					"deleted":  deleted,
+				},
+			})
 		} else {
-			log.Printf("unable to handle webhook: %v", backupData)
+			b.logger.Error("unable to handle webhook", withTraceID(traceID, map[string]interface{}{"backupData": backupData}))
+			webhooksReceivedTotal.WithLabelValues("unknown", "error").Inc()
 		}
 	}
 }
 
+// RepublishFromDLQ is an admin endpoint that drains up to a `n` query
+// parameter (default 10) messages from the broker's dead-letter queue,
+// bumps their retry count, and republishes them onto the main queue. It
+// 501s if the configured Broker doesn't support a dead-letter queue.
+func (b *BackupHandler) RepublishFromDLQ(w http.ResponseWriter, r *http.Request) {
+	requeuer, ok := b.broker.(DLQRequeuer)
+	if !ok {
+		http.Error(w, "configured broker does not support dead-letter requeue", http.StatusNotImplemented)
+		return
+	}
+
+	n := 10
+	if raw := r.URL.Query().Get("n"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil {
+			http.Error(w, "invalid n", http.StatusBadRequest)
+			return
+		}
+		n = parsed
+	}
+
+	requeued, err := requeuer.RequeueDLQ(r.Context(), n)
+	if err != nil {
+		b.logger.Error("unable to requeue from dlq", map[string]interface{}{"error": err.Error()})
+		http.Error(w, "unable to requeue from dlq", http.StatusInternalServerError)
+		return
+	}
+	if requeued > 0 {
+		// "dlq_requeue", not "dlq_deposit": this fires when messages are
+		// requeued back out of the dead-letter queue, the only event this
+		// endpoint can observe. Nothing here sees a message actually
+		// landing on the dlq - that happens inside the broker, outside any
+		// code path we touch - so there is no genuine deposit notification
+		// to send.
+		b.notifier.Notify(r.Context(), NotificationEvent{
+			Type:    "dlq_requeue",
+			Message: fmt.Sprintf("%d message(s) requeued from dead-letter queue", requeued),
+			Fields:  map[string]interface{}{"count": requeued},
+		})
+	}
+	fmt.Fprintf(w, "requeued %d message(s) from dlq\n", requeued)
+}
+
 // ProcessBackups .
 func (b *BackupHandler) ProcessBackups(backupData Backups, backupsEnv api.Environment) []Webhook {
 	var addBackups []Webhook
@@ -206,22 +381,33 @@ func (b *BackupHandler) ProcessBackups(backupData Backups, backupsEnv api.Enviro
 					},
 				}
 				addBackups = append(addBackups, singleBackup)
+			} else {
+				snapshotsProcessedTotal.WithLabelValues("skipped").Inc()
 			}
 		}
 	}
 	return addBackups
 }
 
+// notifyGraphQLFailure fans out a notification for a failed call against
+// the Lagoon GraphQL API, which previously only reached stdout.
+func (b *BackupHandler) notifyGraphQLFailure(ctx context.Context, project string, err error) {
+	b.notifier.Notify(ctx, NotificationEvent{
+		Type:    "graphql_api_failure",
+		Message: fmt.Sprintf("graphql api call failed for %s: %s", project, err.Error()),
+		Fields: map[string]interface{}{
+			"project": project,
+			"error":   err.Error(),
+		},
+	})
+}
+
 func failOnError(err error, msg string) {
 	if err != nil {
-		log.Printf("rabbit failure, error is %s:", err.Error())
+		defaultLogger.Error(msg, map[string]interface{}{"error": err.Error()})
 	}
 }
 
-func removeSnapshot(snapshots []Snapshot, s int) []Snapshot {
-	return append(snapshots[:s], snapshots[s+1:]...)
-}
-
 func apiBackupInWebhook(slice []Snapshot, item string) bool {
 	for _, v := range slice {
 		if v.ID == item {
@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestWebhookHandlerRestorePublishesToMemoryConn exercises WebhookHandler
+// end-to-end against a MemoryConn broker, with no live RabbitMQ/NATS
+// required. It drives the restore path, since that's the one branch of
+// WebhookHandler that never calls out to the Lagoon GraphQL API.
+func TestWebhookHandlerRestorePublishesToMemoryConn(t *testing.T) {
+	broker := NewMemoryBroker(MemoryBroker{})
+
+	backupHandler, err := NewBackupHandler(broker, "restic-backups", t.TempDir(), WebhookAuth{}, NotifyConfig{}, GraphQLEndpoint{})
+	if err != nil {
+		t.Fatalf("NewBackupHandler: %s", err)
+	}
+
+	body, err := json.Marshal(Backups{
+		Name:            "test-project",
+		RestoreLocation: "s3://bucket/restore",
+	})
+	if err != nil {
+		t.Fatalf("marshal request body: %s", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+
+	backupHandler.WebhookHandler(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+
+	if len(broker.Published) != 1 {
+		t.Fatalf("expected 1 published message, got %d", len(broker.Published))
+	}
+	if broker.Published[0].RoutingKey != "restic-backups" {
+		t.Fatalf("expected routing key %q, got %q", "restic-backups", broker.Published[0].RoutingKey)
+	}
+
+	var published Webhook
+	if err := json.Unmarshal(broker.Published[0].Body, &published); err != nil {
+		t.Fatalf("unmarshal published message: %s", err)
+	}
+	if published.Event != "restore:finished" {
+		t.Fatalf("expected event %q, got %q", "restore:finished", published.Event)
+	}
+}
@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	webhooksReceivedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backup_webhooks_received_total",
+		Help: "Total number of webhooks received, by event and result.",
+	}, []string{"event", "result"})
+
+	snapshotsProcessedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backup_snapshots_processed_total",
+		Help: "Total number of snapshots processed, by action taken.",
+	}, []string{"action"})
+
+	queuePublishFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "backup_queue_publish_failures_total",
+		Help: "Total number of failed attempts to publish a webhook to the broker.",
+	})
+
+	graphqlRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "backup_graphql_request_duration_seconds",
+		Help: "Duration of calls against the Lagoon GraphQL API, by operation.",
+	}, []string{"operation"})
+
+	rabbitmqConnected = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "backup_rabbitmq_connected",
+		Help: "1 if the AMQP (RabbitMQ) broker is currently connected, 0 otherwise. Other broker types never set it.",
+	})
+)
+
+// MetricsHandler exposes the collected series for a /metrics scrape,
+// alongside the webhook endpoint.
+func MetricsHandler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,149 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+)
+
+var spoolBucket = []byte("webhooks")
+
+// Spool is a durable, on-disk queue of Webhook messages waiting to be
+// published. addToMessageQueue writes every message here before attempting
+// Broker.Publish, and acks it once the publish succeeds, so a crash or a
+// broker outage between those two steps never silently loses a webhook.
+type Spool struct {
+	db *bolt.DB
+}
+
+// SpoolEntry is a single unacked message read back out of the Spool.
+type SpoolEntry struct {
+	ID      string
+	Message Webhook
+}
+
+// NewSpool opens (creating if necessary) a Spool rooted at dir.
+func NewSpool(dir string) (*Spool, error) {
+	db, err := bolt.Open(dir+"/spool.db", 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open spool: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(spoolBucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialise spool bucket: %w", err)
+	}
+	return &Spool{db: db}, nil
+}
+
+// Put durably records message and returns the ID it was spooled under.
+func (s *Spool) Put(message Webhook) (string, error) {
+	id := uuid.New().String()
+	data, err := json.Marshal(message)
+	if err != nil {
+		return "", err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(spoolBucket).Put([]byte(id), data)
+	})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Ack removes a successfully published message from the spool.
+func (s *Spool) Ack(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(spoolBucket).Delete([]byte(id))
+	})
+}
+
+// Pending returns every message that has not yet been acked, e.g. ones left
+// over from a previous process or a broker outage.
+func (s *Spool) Pending() ([]SpoolEntry, error) {
+	var entries []SpoolEntry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(spoolBucket).ForEach(func(k, v []byte) error {
+			var message Webhook
+			if err := json.Unmarshal(v, &message); err != nil {
+				return err
+			}
+			entries = append(entries, SpoolEntry{ID: string(k), Message: message})
+			return nil
+		})
+	})
+	return entries, err
+}
+
+// Close closes the underlying database.
+func (s *Spool) Close() error {
+	return s.db.Close()
+}
+
+// drainSpool runs in the background for the lifetime of the BackupHandler,
+// retrying unacked spool entries with exponential backoff and jitter until
+// the broker accepts them.
+func (b *BackupHandler) drainSpool(ctx context.Context) {
+	backoff := time.Second
+	const maxBackoff = 2 * time.Minute
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		pending, err := b.spool.Pending()
+		if err != nil {
+			defaultLogger.Error("spool drain: unable to list pending entries", map[string]interface{}{"error": err.Error()})
+			continue
+		}
+		if len(pending) == 0 {
+			backoff = time.Second
+			continue
+		}
+
+		drained := 0
+		for _, entry := range pending {
+			data, err := json.Marshal(entry.Message)
+			if err != nil {
+				continue
+			}
+			if err := b.broker.Publish(ctx, b.queueName, data); err != nil {
+				queuePublishFailuresTotal.Inc()
+				defaultLogger.Error("spool drain: failed to publish spooled webhook", map[string]interface{}{"spool_id": entry.ID, "error": err.Error()})
+				continue
+			}
+			if err := b.spool.Ack(entry.ID); err != nil {
+				defaultLogger.Error("spool drain: failed to ack spooled webhook", map[string]interface{}{"spool_id": entry.ID, "error": err.Error()})
+				continue
+			}
+			drained++
+		}
+
+		if drained < len(pending) {
+			backoff = nextBackoff(backoff, maxBackoff)
+		} else {
+			backoff = time.Second
+		}
+	}
+}
+
+// nextBackoff doubles backoff (capped at max) and adds up to 20% jitter so
+// a fleet of handlers reconnecting at once doesn't thunder the broker.
+func nextBackoff(backoff, max time.Duration) time.Duration {
+	next := backoff * 2
+	if next > max {
+		next = max
+	}
+	jitter := time.Duration(rand.Int63n(int64(next) / 5))
+	return next + jitter
+}